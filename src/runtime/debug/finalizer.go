@@ -0,0 +1,60 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug
+
+import "unsafe"
+
+// FinalizerLeakReport describes a single object that the checkmark-based
+// finalizer and cleanup audit run by CheckFinalizerLeaks found still
+// reachable from its own finalizer or cleanup function. Such an object can
+// never be collected, since running its finalizer or cleanup can never
+// make it unreachable.
+type FinalizerLeakReport struct {
+	// Object is the address of the leaked value, for identification
+	// purposes only. It must not be dereferenced.
+	Object unsafe.Pointer
+
+	// Type is the name of Object's type.
+	Type string
+
+	// Kind is either "finalizer" or "cleanup", identifying which kind of
+	// leak was found.
+	Kind string
+
+	// FinalizerPC is the program counter of the function or argument
+	// through which Object is reachable from its finalizer or cleanup.
+	FinalizerPC uintptr
+
+	// CreationPC is the program counter of the call that registered the
+	// finalizer or cleanup on Object.
+	CreationPC uintptr
+}
+
+// CheckFinalizerLeaks runs the same checkmark-based audit as
+// GODEBUG=checkfinalizers=1 and reports every object it finds reachable
+// from its own finalizer or cleanup function. Unlike the GODEBUG mode, it
+// does not crash the program: it briefly stops the world to run the audit
+// and returns whatever it finds, so tests and long-running services can
+// check for finalizer and cleanup leaks on their own schedule.
+//
+// CheckFinalizerLeaks is expensive: it stops the world and retraverses the
+// heap from every registered finalizer and cleanup. It's meant for
+// periodic use in tests and diagnostics, not for use on a hot path.
+func CheckFinalizerLeaks() []FinalizerLeakReport {
+	var reports []FinalizerLeakReport
+	checkFinalizerLeaks(func(obj unsafe.Pointer, typ, kind string, fnPC, createPC uintptr) {
+		reports = append(reports, FinalizerLeakReport{
+			Object:      obj,
+			Type:        typ,
+			Kind:        kind,
+			FinalizerPC: fnPC,
+			CreationPC:  createPC,
+		})
+	})
+	return reports
+}
+
+// checkFinalizerLeaks is implemented in the runtime package.
+func checkFinalizerLeaks(report func(obj unsafe.Pointer, typ, kind string, fnPC, createPC uintptr))
@@ -0,0 +1,104 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package debug_test
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+// leaker is kept reachable from its own finalizer below, which is exactly
+// the kind of leak CheckFinalizerLeaks is meant to catch.
+type leaker struct{}
+
+func TestCheckFinalizerLeaksDetectsSelfCapture(t *testing.T) {
+	obj := new(leaker)
+	runtime.SetFinalizer(obj, func(l *leaker) {
+		// Capturing obj itself keeps it reachable from its own finalizer.
+		_ = obj
+	})
+
+	var reports []debug.FinalizerLeakReport
+	for i := 0; i < 10 && len(reports) == 0; i++ {
+		runtime.GC()
+		reports = debug.CheckFinalizerLeaks()
+	}
+
+	found := false
+	for _, r := range reports {
+		if r.Kind == "finalizer" && r.Type == "*debug_test.leaker" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("CheckFinalizerLeaks() = %+v, want a report for the self-capturing finalizer", reports)
+	}
+
+	runtime.KeepAlive(obj)
+}
+
+func TestCheckFinalizerLeaksIgnoresCleanFinalizer(t *testing.T) {
+	obj := new(leaker)
+	runtime.SetFinalizer(obj, func(l *leaker) {})
+	obj = nil
+
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+	}
+
+	for _, r := range debug.CheckFinalizerLeaks() {
+		if r.Type == "*debug_test.leaker" {
+			t.Fatalf("CheckFinalizerLeaks() unexpectedly reported a clean finalizer: %+v", r)
+		}
+	}
+}
+
+// bigLeaker pads the live heap well past checkmarkParallelMinHeapBytes, so
+// that CheckFinalizerLeaks below is forced onto the runtime's parallel
+// checkmark fan-out instead of the single-gcWork path.
+type bigLeaker struct {
+	pad [1 << 20]byte
+}
+
+func TestCheckFinalizerLeaksDetectsSelfCaptureWithParallelFanout(t *testing.T) {
+	if old := runtime.GOMAXPROCS(0); old < 2 {
+		runtime.GOMAXPROCS(2)
+		defer runtime.GOMAXPROCS(old)
+	}
+
+	// Keep enough bigLeakers reachable to push live heap bytes above the
+	// threshold that switches runCheckmarkStep to its fanned-out path.
+	const n = 80 // 80 MiB, above the 64 MiB threshold.
+	objs := make([]*bigLeaker, n)
+	for i := range objs {
+		obj := new(bigLeaker)
+		runtime.SetFinalizer(obj, func(l *bigLeaker) {
+			// Capturing the whole slice keeps every element reachable from
+			// its own finalizer.
+			_ = objs
+		})
+		objs[i] = obj
+	}
+
+	var reports []debug.FinalizerLeakReport
+	for i := 0; i < 10 && len(reports) < n; i++ {
+		runtime.GC()
+		reports = debug.CheckFinalizerLeaks()
+	}
+
+	found := 0
+	for _, r := range reports {
+		if r.Kind == "finalizer" && r.Type == "*debug_test.bigLeaker" {
+			found++
+		}
+	}
+	if found == 0 {
+		t.Fatalf("CheckFinalizerLeaks() found %d self-capturing bigLeakers, want at least 1", found)
+	}
+
+	runtime.KeepAlive(objs)
+}
@@ -23,6 +23,15 @@ import (
 // per-arena bitmap with a bit for every word in the arena. The mark
 // is stored on the bit corresponding to the first word of the marked
 // allocation.
+//
+// Unlike most of the arena's other per-arena metadata, a checkmarksMap is
+// not kept around for the arena's lifetime: at a full heapArenaBytes/
+// goarch.PtrSize/8 bytes (1 MiB for a 64 MiB arena), holding one per arena
+// permanently would make checkfinalizers auditing (which can run this
+// phase far more often than GODEBUG=gccheckmark=1 ever did) too expensive
+// to enable on large heaps. Instead, startCheckmarks allocates a bitmap
+// only for arenas that actually have live spans at the time, and
+// endCheckmarks frees every bitmap it allocated back to gcMiscSys.
 type checkmarksMap struct {
 	_ sys.NotInHeap
 	b [heapArenaBytes / goarch.PtrSize / 8]uint8
@@ -32,45 +41,77 @@ type checkmarksMap struct {
 // bits instead of the standard mark bits.
 var useCheckmark = false
 
+// arenaHasLiveSpans reports whether ai's arena has any in-use pages, and
+// is therefore worth allocating a checkmarksMap for.
+func arenaHasLiveSpans(ai arenaIdx) bool {
+	ha := mheap_.arenas[ai.l1()][ai.l2()]
+	for _, inUse := range ha.pageInUse {
+		if inUse != 0 {
+			return true
+		}
+	}
+	return false
+}
+
 // startCheckmarks prepares for the checkmarks phase.
 //
 // The world must be stopped.
 func startCheckmarks() {
 	assertWorldStopped()
 
-	// Clear all checkmarks.
-	clearCheckmarks := func(ai arenaIdx) {
+	// Allocate (or clear) a checkmarks bitmap for every arena that has
+	// something worth checkmarking.
+	allocCheckmarks := func(ai arenaIdx) {
 		arena := mheap_.arenas[ai.l1()][ai.l2()]
-		bitmap := arena.checkmarks
-
+		if arena.checkmarks != nil {
+			// Leftover from a checkmarks phase that didn't clean up after
+			// itself (e.g. a throw mid-phase); just clear it.
+			clear(arena.checkmarks.b[:])
+			return
+		}
+		if !arenaHasLiveSpans(ai) {
+			// Nothing allocated here yet; don't bother with a bitmap.
+			return
+		}
+		bitmap := (*checkmarksMap)(sysAlloc(unsafe.Sizeof(checkmarksMap{}), &memstats.gcMiscSys))
 		if bitmap == nil {
-			// Allocate bitmap on first use.
-			bitmap = (*checkmarksMap)(persistentalloc(unsafe.Sizeof(*bitmap), 0, &memstats.gcMiscSys))
-			if bitmap == nil {
-				throw("out of memory allocating checkmarks bitmap")
-			}
-			arena.checkmarks = bitmap
-		} else {
-			// Otherwise clear the existing bitmap.
-			clear(bitmap.b[:])
+			throw("out of memory allocating checkmarks bitmap")
 		}
+		arena.checkmarks = bitmap
 	}
 	for _, ai := range mheap_.heapArenas {
-		clearCheckmarks(ai)
+		allocCheckmarks(ai)
 	}
 	for _, ai := range mheap_.userArenaArenas {
-		clearCheckmarks(ai)
+		allocCheckmarks(ai)
 	}
 
 	// Enable checkmarking.
 	useCheckmark = true
 }
 
-// endCheckmarks ends the checkmarks phase.
+// endCheckmarks ends the checkmarks phase, freeing every checkmarks
+// bitmap startCheckmarks allocated.
 func endCheckmarks() {
 	if gcMarkWorkAvailable(nil) {
 		throw("GC work not flushed")
 	}
+
+	freeCheckmarks := func(ai arenaIdx) {
+		arena := mheap_.arenas[ai.l1()][ai.l2()]
+		if arena.checkmarks == nil {
+			return
+		}
+		sysFree(unsafe.Pointer(arena.checkmarks), unsafe.Sizeof(checkmarksMap{}), &memstats.gcMiscSys)
+		arena.checkmarks = nil
+	}
+	for _, ai := range mheap_.heapArenas {
+		freeCheckmarks(ai)
+	}
+	for _, ai := range mheap_.userArenaArenas {
+		freeCheckmarks(ai)
+	}
+
 	useCheckmark = false
 }
 
@@ -107,8 +148,9 @@ func setCheckmark(obj, base, off uintptr, mbits markBits) bool {
 func getCheckmark(obj uintptr) (bytep *byte, mask uint8) {
 	ai := arenaIndex(obj)
 	arena := mheap_.arenas[ai.l1()][ai.l2()]
-	if arena == nil {
-		// Non-heap pointer.
+	if arena == nil || arena.checkmarks == nil {
+		// Non-heap pointer, or an arena startCheckmarks saw no live spans
+		// in (and so never bothered allocating a bitmap for).
 		return nil, 0
 	}
 	wordIdx := (obj - alignDown(obj, heapArenaBytes)) / goarch.PtrSize
@@ -118,12 +160,62 @@ func getCheckmark(obj uintptr) (bytep *byte, mask uint8) {
 	return bytep, mask
 }
 
-// runCheckmark runs a full non-parallel, stop-the-world mark using
-// checkmark bits, to check that we didn't forget to mark anything
-// during the concurrent mark process.
+// rootPartition identifies one worker's shard of the root set passed to a
+// runCheckmark prepareRootSet callback, out of nWorkers total shards.
+type rootPartition struct {
+	shard    int
+	nWorkers int
+}
+
+// owns reports whether root index i belongs to this partition. Callers
+// that enumerate their roots by index should skip any i for which owns
+// returns false, leaving it for a different worker to enqueue. Callers
+// with a single, unpartitionable root can just check owns(0), so that
+// only one worker ends up enqueuing it.
+func (rp rootPartition) owns(i int) bool {
+	return i%rp.nWorkers == rp.shard
+}
+
+// checkmarkParallelMinHeapBytes is the smallest live heap size at which
+// runCheckmark fans its root set out across multiple P's gcWorks instead
+// of draining it serially on the current M. Below this, the fixed cost of
+// coordinating parallel workers isn't worth paying.
+const checkmarkParallelMinHeapBytes = 64 << 20
+
+// runCheckmark runs a single, self-contained checkmarks phase: it starts
+// the phase, runs one mark using runCheckmarkStep, and ends the phase.
+//
+// Callers that need to run several marks in a row (e.g.
+// collectFinalizerLeaks, once per finalizer/cleanup) should call
+// startCheckmarks and endCheckmarks themselves around a loop of
+// runCheckmarkStep calls instead: startCheckmarks/endCheckmarks allocate
+// and free every live arena's checkmarks bitmap (see checkmarksMap), so
+// paying for that once per mark instead of once for the whole scan would
+// defeat the point of making that allocation lazy.
 //
 // The world must be stopped to call runCheckmark.
-func runCheckmark(prepareRootSet func(*gcWork)) {
+func runCheckmark(prepareRootSet func(rootPartition, *gcWork)) {
+	assertWorldStopped()
+
+	startCheckmarks()
+	runCheckmarkStep(prepareRootSet)
+	endCheckmarks()
+}
+
+// runCheckmarkStep runs a full stop-the-world mark using checkmark bits,
+// to check that we didn't forget to mark anything during the concurrent
+// mark process. For heaps at or above checkmarkParallelMinHeapBytes live
+// bytes, the mark is fanned out across every P's gcWork and drained in
+// parallel by runCheckmarkFanout; smaller heaps just use the current M's
+// gcWork, to avoid paying for coordination that a small retraversal
+// doesn't need.
+//
+// prepareRootSet is called once per worker with that worker's
+// rootPartition and the gcWork to enqueue its share of the roots into.
+//
+// The world must be stopped, and a checkmarks phase must already be
+// underway (see startCheckmarks), to call runCheckmarkStep.
+func runCheckmarkStep(prepareRootSet func(rootPartition, *gcWork)) {
 	assertWorldStopped()
 
 	// Turn off gcwaiting because that will force
@@ -132,38 +224,200 @@ func runCheckmark(prepareRootSet func(*gcWork)) {
 	// This is fine because the world is stopped.
 	// Restore it after we're done just to be safe.
 	sched.gcwaiting.Store(false)
-	startCheckmarks()
 	gcResetMarkState()
-	gcw := &getg().m.p.ptr().gcw
-	prepareRootSet(gcw)
-	gcDrain(gcw, 0)
-	wbBufFlush1(getg().m.p.ptr())
-	gcw.dispose()
-	endCheckmarks()
+
+	// Clear any checkmarks left by an earlier step in the same phase, so
+	// that this mark starts from nothing.
+	clearCheckmarks := func(ai arenaIdx) {
+		arena := mheap_.arenas[ai.l1()][ai.l2()]
+		if arena.checkmarks != nil {
+			clear(arena.checkmarks.b[:])
+		}
+	}
+	for _, ai := range mheap_.heapArenas {
+		clearCheckmarks(ai)
+	}
+	for _, ai := range mheap_.userArenaArenas {
+		clearCheckmarks(ai)
+	}
+
+	nWorkers := 1
+	if gcController.heapLive.Load() >= checkmarkParallelMinHeapBytes {
+		nWorkers = gomaxprocs
+	}
+	if nWorkers <= 1 {
+		gcw := &getg().m.p.ptr().gcw
+		prepareRootSet(rootPartition{0, 1}, gcw)
+		gcDrain(gcw, 0)
+		wbBufFlush1(getg().m.p.ptr())
+		gcw.dispose()
+	} else {
+		runCheckmarkFanout(prepareRootSet, nWorkers)
+	}
+
 	sched.gcwaiting.Store(true)
 }
 
-// checkFinalizersAndCleanups uses checkmarks to check for potential issues
-// with the program's use of cleanups and finalizers.
-func checkFinalizersAndCleanups() {
+// checkmarkHelper is one dedicated OS thread used by runCheckmarkFanout to
+// get genuine parallelism out of a stop-the-world mark.
+//
+// forEachP can't do this on its own: runCheckmark requires the world to
+// already be stopped, which means every P besides the caller's is already
+// idle by the time runCheckmarkFanout runs, and forEachP just calls its
+// callback for each idle P synchronously, one at a time, on the calling M
+// (see forEachP's handling of sched.pidle). Routing the fan-out through
+// forEachP would therefore serialize every shard onto the calling M
+// anyway, buying none of the speedup large heaps need. A checkmarkHelper
+// instead parks on its own M between uses, so the shard it's handed
+// actually runs concurrently with the calling M's shard and with every
+// other helper's.
+type checkmarkHelper struct {
+	wake note // woken, with job and pp set, to run a shard
+	rest note // woken once that shard is done
+
+	pp  *p
+	job func(pp *p)
+}
+
+func (h *checkmarkHelper) run() {
+	// run is an M's startup fn (see newm in acquireCheckmarkHelpers), so it
+	// executes on that M's g0: getg().m.curg is nil here, same as any
+	// other bare M. h.job ends up calling gcDrain, which reads
+	// getg().m.curg.preempt, so give this M a curg of its own to read that
+	// from. It's never scheduled or run on, so it needs no stack; this is
+	// the same trick oneNewExtraM uses to give cgo callback Ms a curg.
+	gp := malg(-1)
+	gp.m = getg().m
+	getg().m.curg = gp
+
+	for {
+		notesleep(&h.wake)
+		noteclear(&h.wake)
+		h.job(h.pp)
+		notewakeup(&h.rest)
+	}
+}
+
+var checkmarkHelpersMu mutex
+var checkmarkHelpers []*checkmarkHelper
+
+// acquireCheckmarkHelpers returns the process-wide pool of
+// checkmarkHelpers, starting it (one dedicated M per P beyond the first)
+// the first time it's needed.
+func acquireCheckmarkHelpers() []*checkmarkHelper {
+	lock(&checkmarkHelpersMu)
+	if checkmarkHelpers == nil {
+		n := gomaxprocs - 1
+		if n < 0 {
+			n = 0
+		}
+		helpers := make([]*checkmarkHelper, n)
+		for i := range helpers {
+			h := new(checkmarkHelper)
+			helpers[i] = h
+			newm(h.run, nil, -1)
+		}
+		checkmarkHelpers = helpers
+	}
+	helpers := checkmarkHelpers
+	unlock(&checkmarkHelpersMu)
+	return helpers
+}
+
+// runCheckmarkFanout runs prepareRootSet and gcDrain across nWorkers of
+// allp's gcWorks in parallel: shard 0 runs on the calling M, and every
+// other shard runs on its own dedicated checkmarkHelper M, so the drains
+// genuinely overlap instead of running one after another. Checkmark
+// bitmap updates are already atomic (see setCheckmark's use of
+// atomic.Or8), so the only synchronization the workers need is waiting
+// for all of them to finish.
+//
+// The world must be stopped.
+func runCheckmarkFanout(prepareRootSet func(rootPartition, *gcWork), nWorkers int) {
 	assertWorldStopped()
 
-	type report struct {
+	helpers := acquireCheckmarkHelpers()
+	nHelpers := nWorkers - 1
+	if nHelpers > len(helpers) {
+		// There are more workers than helpers (e.g. GOMAXPROCS was just
+		// raised); just use as many helpers as we have.
+		nHelpers = len(helpers)
+	}
+	nWorkers = nHelpers + 1
+
+	drain := func(pp *p, shard int) {
+		gcw := &pp.gcw
+		prepareRootSet(rootPartition{shard, nWorkers}, gcw)
+		gcDrain(gcw, 0)
+		wbBufFlush1(pp)
+		gcw.dispose()
+	}
+
+	for i := 0; i < nHelpers; i++ {
+		h := helpers[i]
+		h.pp = allp[i+1]
+		shard := i + 1
+		h.job = func(pp *p) { drain(pp, shard) }
+		notewakeup(&h.wake)
+	}
+
+	// Run shard 0 on the calling M while the helpers run theirs.
+	drain(allp[0], 0)
+
+	for i := 0; i < nHelpers; i++ {
+		h := helpers[i]
+		notesleep(&h.rest)
+		noteclear(&h.rest)
+	}
+}
+
+// checkFinalizerLeak describes a single object that appears to be kept
+// alive by its own finalizer or cleanup. It is the unit of work shared by
+// checkFinalizersAndCleanups (which prints up to 25 leaks and then throws) and
+// checkFinalizerLeaksForDebug, which implements the non-fatal
+// runtime/debug.CheckFinalizerLeaks.
+type checkFinalizerLeak struct {
+	obj      uintptr
+	typ      string
+	kind     string // "finalizer" or "cleanup"
+	fnPC     uintptr
+	createPC uintptr
+}
+
+// collectFinalizerLeaks uses checkmarks to check for potential issues with
+// the program's use of cleanups and finalizers, collecting up to limit
+// leaks (or all of them, if limit is negative). more reports whether
+// additional leaks existed beyond limit.
+//
+// collectFinalizerLeaks runs one checkmark mark per finalizer and cleanup
+// special, so it keeps a single checkmarks phase (see startCheckmarks)
+// open across the whole scan rather than starting and ending one per
+// special: specials are commonly numerous, and startCheckmarks/
+// endCheckmarks allocate and free a bitmap per live arena.
+//
+// The world must be stopped.
+func collectFinalizerLeaks(limit int) (leaks []checkFinalizerLeak, more bool) {
+	assertWorldStopped()
+
+	type pending struct {
 		ptr uintptr
 		sp  *special
 	}
-	var reports [25]report
-	var nreports int
-	var more bool
+	var pendings []pending
 
+	startCheckmarks()
 	forEachSpecial(func(p uintptr, s *mspan, sp *special) bool {
 		// We only care about finalizers and cleanups.
 		if sp.kind != _KindSpecialFinalizer && sp.kind != _KindSpecialCleanup {
 			return true
 		}
 
-		// Run a checkmark GC using this cleanup and/or finalizer as a root.
-		runCheckmark(func(gcw *gcWork) {
+		// Run a checkmark mark using this cleanup and/or finalizer as a root.
+		// There's only one root here, so only one worker should enqueue it.
+		runCheckmarkStep(func(part rootPartition, gcw *gcWork) {
+			if !part.owns(0) {
+				return
+			}
 			switch sp.kind {
 			case _KindSpecialFinalizer:
 				gcScanFinalizer((*specialfinalizer)(unsafe.Pointer(sp)), s, gcw)
@@ -180,66 +434,108 @@ func checkFinalizersAndCleanups() {
 		if bytep == nil {
 			return true
 		}
-		if atomic.Load8(bytep)&mask != 0 {
-			if nreports >= len(reports) {
-				more = true
-				return false
-			}
-			reports[nreports] = report{p, sp}
-			nreports++
+		if atomic.Load8(bytep)&mask == 0 {
+			return true
+		}
+		if limit >= 0 && len(pendings) >= limit {
+			more = true
+			return false
 		}
+		pendings = append(pendings, pending{p, sp})
 		return true
 	})
+	endCheckmarks()
 
-	if nreports > 0 {
-		lastPtr := uintptr(0)
-		for _, r := range reports[:nreports] {
-			var ctx *specialCheckFinalizer
-			var kind string
-			if r.sp.kind == _KindSpecialFinalizer {
-				kind = "finalizer"
-				ctx = getCleanupContext(r.ptr, 0)
-			} else {
-				kind = "cleanup"
-				ctx = getCleanupContext(r.ptr, ((*specialCleanup)(unsafe.Pointer(r.sp))).id)
-			}
+	leaks = make([]checkFinalizerLeak, len(pendings))
+	for i, r := range pendings {
+		leak := &leaks[i]
+		leak.obj = r.ptr
 
-			// N.B. reports is sorted 'enough' that cleanups/finalizers on the same pointer will
-			// appear consecutively because the specials list is sorted.
-			if lastPtr != r.ptr {
-				if lastPtr != 0 {
-					println()
-				}
-				print("runtime: value of type ", toRType(ctx.ptrType).string(), " @ ", hex(r.ptr), " is reachable from cleanup or finalizer\n")
-				println("value reachable from function or argument at one of:")
-			}
+		var ctx *specialCheckFinalizer
+		if r.sp.kind == _KindSpecialFinalizer {
+			leak.kind = "finalizer"
+			ctx = getCleanupContext(r.ptr, 0)
+		} else {
+			leak.kind = "cleanup"
+			ctx = getCleanupContext(r.ptr, ((*specialCleanup)(unsafe.Pointer(r.sp))).id)
+		}
+		leak.typ = toRType(ctx.ptrType).string()
+		leak.fnPC = ctx.funcPC
+		leak.createPC = ctx.createPC
+	}
+	return leaks, more
+}
 
-			funcInfo := findfunc(ctx.funcPC)
-			if funcInfo.valid() {
-				file, line := funcline(funcInfo, ctx.createPC)
-				print(funcname(funcInfo), " (", kind, ")\n")
-				print("\t", file, ":", line, "\n")
-			} else {
-				print("<bad pc ", hex(ctx.funcPC), ">\n")
-			}
+// checkFinalizersAndCleanups uses checkmarks to check for potential issues
+// with the program's use of cleanups and finalizers.
+func checkFinalizersAndCleanups() {
+	assertWorldStopped()
+
+	leaks, more := collectFinalizerLeaks(25)
+	if len(leaks) == 0 {
+		return
+	}
 
-			print("created at: ")
-			createInfo := findfunc(ctx.createPC)
-			if createInfo.valid() {
-				file, line := funcline(createInfo, ctx.createPC)
-				print(funcname(createInfo), "\n")
-				print("\t", file, ":", line, "\n")
-			} else {
-				print("<bad pc ", hex(ctx.createPC), ">\n")
+	lastPtr := uintptr(0)
+	for _, leak := range leaks {
+		// N.B. reports is sorted 'enough' that cleanups/finalizers on the same pointer will
+		// appear consecutively because the specials list is sorted.
+		if lastPtr != leak.obj {
+			if lastPtr != 0 {
+				println()
 			}
+			print("runtime: value of type ", leak.typ, " @ ", hex(leak.obj), " is reachable from cleanup or finalizer\n")
+			println("value reachable from function or argument at one of:")
+		}
 
-			lastPtr = r.ptr
+		funcInfo := findfunc(leak.fnPC)
+		if funcInfo.valid() {
+			file, line := funcline(funcInfo, leak.createPC)
+			print(funcname(funcInfo), " (", leak.kind, ")\n")
+			print("\t", file, ":", line, "\n")
+		} else {
+			print("<bad pc ", hex(leak.fnPC), ">\n")
 		}
-		println()
-		if more {
-			println("runtime: too many errors")
+
+		print("created at: ")
+		createInfo := findfunc(leak.createPC)
+		if createInfo.valid() {
+			file, line := funcline(createInfo, leak.createPC)
+			print(funcname(createInfo), "\n")
+			print("\t", file, ":", line, "\n")
+		} else {
+			print("<bad pc ", hex(leak.createPC), ">\n")
 		}
-		throw("runtime: detected possible cleanup and/or finalizer leaks")
+
+		lastPtr = leak.obj
+	}
+	println()
+	if more {
+		println("runtime: too many errors")
+	}
+	throw("runtime: detected possible cleanup and/or finalizer leaks")
+}
+
+// checkFinalizerLeaksForDebug implements runtime/debug.CheckFinalizerLeaks.
+// Unlike checkFinalizersAndCleanups, it does not throw: it stops the world
+// just long enough to run the same checkmark audit, then hands every leak
+// it finds to report.
+//
+//go:linkname checkFinalizerLeaksForDebug runtime/debug.checkFinalizerLeaks
+func checkFinalizerLeaksForDebug(report func(obj unsafe.Pointer, typ, kind string, fnPC, createPC uintptr)) {
+	// Unlike checkFinalizersAndCleanups, this path isn't called while the
+	// world happens to already be stopped for a GC, so it has to stop it
+	// itself. Label the stop with its own stwCheckFinalizerLeaks reason
+	// rather than folding it into an unrelated one like stwReadMemStats:
+	// this stop can take much longer than a stat read (it's a full
+	// checkmark retraversal of the heap), and trace/latency tooling that
+	// keys off stwReason would otherwise blame the wrong cause.
+	stw := stopTheWorld(stwCheckFinalizerLeaks)
+	leaks, _ := collectFinalizerLeaks(-1)
+	startTheWorld(stw)
+
+	for _, leak := range leaks {
+		report(unsafe.Pointer(leak.obj), leak.typ, leak.kind, leak.fnPC, leak.createPC)
 	}
 }
 
@@ -0,0 +1,35 @@
+// Copyright 2026 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+import "testing"
+
+func TestRootPartitionOwns(t *testing.T) {
+	const nWorkers = 4
+	const nRoots = 17
+
+	ownerCount := make([]int, nRoots)
+	perWorker := make([]int, nWorkers)
+	for shard := 0; shard < nWorkers; shard++ {
+		part := rootPartition{shard, nWorkers}
+		for i := 0; i < nRoots; i++ {
+			if part.owns(i) {
+				ownerCount[i]++
+				perWorker[shard]++
+			}
+		}
+	}
+
+	for i, n := range ownerCount {
+		if n != 1 {
+			t.Errorf("root %d is owned by %d workers, want exactly 1", i, n)
+		}
+	}
+	for shard, n := range perWorker {
+		if n == 0 {
+			t.Errorf("worker %d (of %d) was never assigned a root", shard, nWorkers)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package runtime
+
+type stwReason uint8
+
+// Reasons to stop-the-world.
+//
+// Avoid reusing reasons and add new ones instead.
+const (
+	stwUnknown                     stwReason = iota // "unknown"
+	stwGCMarkTerm                                    // "GC mark termination"
+	stwGCSweepTerm                                   // "GC sweep termination"
+	stwWriteHeapDump                                 // "write heap dump"
+	stwGoroutineProfile                              // "goroutine profile"
+	stwGoroutineProfileCleanup                       // "goroutine profile cleanup"
+	stwAllGoroutinesStack                            // "all goroutines stack trace"
+	stwReadMemStats                                  // "read mem stats"
+	stwAllThreadsSyscall                             // "AllThreadsSyscall"
+	stwGOMAXPROCS                                    // "GOMAXPROCS"
+	stwStartTrace                                    // "start trace"
+	stwStopTrace                                     // "stop trace"
+	stwForTestCountPagesInUse                        // "CountPagesInUse (test)"
+	stwForTestReadMetricsSlow                        // "ReadMetricsSlow (test)"
+	stwForTestReadMemStatsSlow                       // "ReadMemStatsSlow (test)"
+	stwForTestPageCachePagesLeaked                   // "PageCachePagesLeaked (test)"
+	stwForTestResetDebugLog                          // "ResetDebugLog (test)"
+	stwCheckFinalizerLeaks                           // "CheckFinalizerLeaks"
+)
+
+func (r stwReason) String() string {
+	return stwReasonStrings[r]
+}
+
+// If you add to this list, also add it to src/internal/trace/parser.go.
+// If you change the values of any of the stw* constants, bump the trace
+// version number and make a copy of this.
+var stwReasonStrings = [...]string{
+	stwUnknown:                      "unknown",
+	stwGCMarkTerm:                   "GC mark termination",
+	stwGCSweepTerm:                  "GC sweep termination",
+	stwWriteHeapDump:                "write heap dump",
+	stwGoroutineProfile:             "goroutine profile",
+	stwGoroutineProfileCleanup:      "goroutine profile cleanup",
+	stwAllGoroutinesStack:           "all goroutines stack trace",
+	stwReadMemStats:                 "read mem stats",
+	stwAllThreadsSyscall:            "AllThreadsSyscall",
+	stwGOMAXPROCS:                   "GOMAXPROCS",
+	stwStartTrace:                   "start trace",
+	stwStopTrace:                    "stop trace",
+	stwForTestCountPagesInUse:       "CountPagesInUse (test)",
+	stwForTestReadMetricsSlow:       "ReadMetricsSlow (test)",
+	stwForTestReadMemStatsSlow:      "ReadMemStatsSlow (test)",
+	stwForTestPageCachePagesLeaked:  "PageCachePagesLeaked (test)",
+	stwForTestResetDebugLog:         "ResetDebugLog (test)",
+	stwCheckFinalizerLeaks:          "CheckFinalizerLeaks",
+}